@@ -36,9 +36,9 @@ func main() {
 	proof, _ := tree.GenerateProof(index)
 	fmt.Printf("Proof for leaf %d:\n", index)
 	for i, p := range proof {
-		fmt.Printf("  [%d] %s\n", i, hex.EncodeToString(p))
+		fmt.Printf("  [%d] %s (right=%v)\n", i, hex.EncodeToString(p.Hash), p.Right)
 	}
 
-	valid := tree.VerifyProof(data[index], index, proof, root)
+	valid := tree.VerifyProof(data[index], proof, root)
 	fmt.Printf("Proof valid? %v\n", valid)
 }
@@ -7,73 +7,222 @@ import "errors"
 // In merkle tree you can depend on this generic HashFn and this can be passed as a parameter to the MerkleTree implementation
 type HashFn func(data []byte) []byte
 
+// TreeMode selects the domain-separation and padding scheme used when
+// hashing leaves/nodes and handling an odd number of nodes at a level.
+type TreeMode int
+
+const (
+	// ModeDuplicate hashes leaves and internal nodes in the same hash space
+	// (no domain separation). The tree is a forest of perfect subtrees, one
+	// per set bit of the leaf count, whose peaks are combined right to left
+	// into the root (see addPeak/bagPeaks). No node is duplicated, so for a
+	// leaf count that is not a power of two the root differs from the older
+	// construction that hashed an unpaired node with itself.
+	ModeDuplicate TreeMode = iota
+
+	// ModeRFC6962 hashes leaves as H(0x00||data) and internal nodes as
+	// H(0x01||left||right), per RFC 6962 (Certificate Transparency). This
+	// closes the second-preimage gap where an internal node hash could be
+	// replayed as a leaf hash. An unpaired node at a level is promoted to
+	// the next level unchanged instead of being duplicated.
+	ModeRFC6962
+
+	// ModeMinimalHeight builds a minimal-height, left-leaning tree
+	// (Tendermint-style): n leaves are split at k, the largest power of
+	// two smaller than n, with the left subtree taking leaves[:k] and the
+	// right subtree taking leaves[k:]. This never duplicates a leaf, so an
+	// attacker cannot forge a node by replaying a duplicated leaf hash.
+	ModeMinimalHeight
+)
+
 type MerkleNode struct {
 	Left  *MerkleNode
 	Right *MerkleNode
 	Hash  []byte
 }
 
+// ProofStep is one hash on a Merkle proof path, together with which side of
+// the accumulated hash it belongs on. Right reports whether Hash should be
+// combined to the right of the hash computed so far (i.e. combined =
+// current || Hash); when false, combined = Hash || current.
+type ProofStep struct {
+	Hash  []byte
+	Right bool
+}
+
+// peak is one perfect binary subtree in the forest maintained by
+// ModeDuplicate trees, so AddLeaf can merge it with the new leaf in O(log n)
+// instead of rebuilding the whole tree. height is the number of levels below
+// the peak's node (0 for a bare leaf).
+type peak struct {
+	height int
+	node   *MerkleNode
+}
+
 type DefaultMerkleTree struct {
 	hashFn HashFn
 	leaves [][]byte
 	root   *MerkleNode
+	mode   TreeMode
+
+	// peaks holds the forest of perfect subtrees backing ModeDuplicate,
+	// ordered left to right with strictly decreasing height, one per set
+	// bit of len(leaves). It is unused by the other modes, which rebuild
+	// the whole tree on every AddLeaf.
+	peaks []*peak
 }
 
 func NewDefaultMerkleTree(hashFn HashFn) *DefaultMerkleTree {
 	return &DefaultMerkleTree{
 		hashFn: hashFn,
+		mode:   ModeDuplicate,
+	}
+}
+
+// NewRFC6962MerkleTree returns a tree that hashes leaves and internal nodes
+// with RFC 6962 domain separation, so proofs generated against it validate
+// against external Certificate Transparency verifiers using the same leaf
+// hash function.
+func NewRFC6962MerkleTree(hashFn HashFn) *DefaultMerkleTree {
+	return &DefaultMerkleTree{
+		hashFn: hashFn,
+		mode:   ModeRFC6962,
+	}
+}
+
+// NewTendermintMerkleTree returns a tree that builds a minimal-height,
+// left-leaning tree by recursively splitting leaves at the largest power of
+// two smaller than the leaf count, instead of duplicating the last leaf at
+// odd levels.
+func NewTendermintMerkleTree(hashFn HashFn) *DefaultMerkleTree {
+	return &DefaultMerkleTree{
+		hashFn: hashFn,
+		mode:   ModeMinimalHeight,
 	}
 }
 
-// AddLeaf adds a new data element to the Merkle tree as a leaf node
+// AddLeaf adds a new data element to the Merkle tree as a leaf node.
+//
+// For ModeDuplicate this merges the new leaf into a forest of perfect
+// subtrees (one per set bit of the leaf count) in amortized O(1), worst
+// case O(log n), instead of rehashing every existing leaf. The other modes
+// still rebuild the whole tree, since their shape depends on the full leaf
+// count rather than an incremental merge.
 func (t *DefaultMerkleTree) AddLeaf(data []byte) error {
 	t.leaves = append(t.leaves, data)
-	t.buildTree()
+
+	if t.mode != ModeDuplicate {
+		t.buildTree()
+		return nil
+	}
+
+	t.addPeak(&MerkleNode{Hash: t.leafHash(data)}, 0)
 	return nil
 }
 
+// addPeak pushes a new subtree of the given height onto the forest, merging
+// it with the top of the stack for as long as the top has the same height.
+func (t *DefaultMerkleTree) addPeak(node *MerkleNode, height int) {
+	for len(t.peaks) > 0 && t.peaks[len(t.peaks)-1].height == height {
+		top := t.peaks[len(t.peaks)-1]
+		t.peaks = t.peaks[:len(t.peaks)-1]
+		node = &MerkleNode{
+			Left:  top.node,
+			Right: node,
+			Hash:  t.nodeHash(top.node.Hash, node.Hash),
+		}
+		height++
+	}
+	t.peaks = append(t.peaks, &peak{height: height, node: node})
+}
+
+// bagPeaks combines the forest's peaks, right to left, into a single root
+// hash: H(peaks[0] || H(peaks[1] || ... H(peaks[n-2] || peaks[n-1]))).
+func (t *DefaultMerkleTree) bagPeaks() []byte {
+	if len(t.peaks) == 0 {
+		return nil
+	}
+
+	hash := t.peaks[len(t.peaks)-1].node.Hash
+	for i := len(t.peaks) - 2; i >= 0; i-- {
+		hash = t.nodeHash(t.peaks[i].node.Hash, hash)
+	}
+	return hash
+}
+
 // Root returns the Merkle root hash representing the entire tree
 func (t *DefaultMerkleTree) Root() []byte {
+	if t.mode == ModeDuplicate {
+		return t.bagPeaks()
+	}
 	if t.root == nil {
 		return nil
 	}
 	return t.root.Hash
 }
 
-// MerkleTree defines the core interface
+// leafHash hashes a leaf's data according to the tree's mode.
+func (t *DefaultMerkleTree) leafHash(data []byte) []byte {
+	if t.mode == ModeRFC6962 {
+		return t.hashFn(append([]byte{0x00}, data...))
+	}
+	return t.hashFn(data)
+}
+
+// nodeHash hashes a pair of child hashes according to the tree's mode.
+func (t *DefaultMerkleTree) nodeHash(left, right []byte) []byte {
+	if t.mode == ModeRFC6962 {
+		combined := append([]byte{0x01}, append(append([]byte{}, left...), right...)...)
+		return t.hashFn(combined)
+	}
+	combined := append(append([]byte{}, left...), right...)
+	return t.hashFn(combined)
+}
+
+// buildTree rebuilds the tree from scratch for the modes that don't use the
+// ModeDuplicate forest (see addPeak/bagPeaks): ModeRFC6962 pairs nodes level
+// by level, promoting an unpaired node unchanged; ModeMinimalHeight
+// recursively splits the leaves.
 //
 // Notes:
 // - Merkle proofs do NOT include the root hash. The verifier must already have the expected root.
 // - A Merkle proof is a min number of hashes needed to recompute the root from a given leaf.
 // - Root verification  = recompute the path from the leaf using the proof and comparing it to the expected root.
 func (t *DefaultMerkleTree) buildTree() {
-	var nodes []*MerkleNode
-	for _, data := range t.leaves {
-		hashed := t.hashFn(data)
-		nodes = append(nodes, &MerkleNode{Hash: hashed})
+	if len(t.leaves) == 0 {
+		t.root = nil
+		return
 	}
 
-	if len(nodes) == 0 {
-		t.root = nil
+	if t.mode == ModeMinimalHeight {
+		t.root = t.buildMinimalHeight(t.leaves)
 		return
 	}
 
+	var nodes []*MerkleNode
+	for _, data := range t.leaves {
+		nodes = append(nodes, &MerkleNode{Hash: t.leafHash(data)})
+	}
+
 	for len(nodes) > 1 {
 		var level []*MerkleNode
 
-		if len(nodes)%2 != 0 {
-			nodes = append(nodes, nodes[len(nodes)-1])
-		}
-
-		for i := 0; i < len(nodes); i += 2 {
-			combined := append(nodes[i].Hash, nodes[i+1].Hash...)
-			parentHash := t.hashFn(combined)
-			parent := &MerkleNode{
-				Left:  nodes[i],
-				Right: nodes[i+1],
-				Hash:  parentHash,
+		i := 0
+		for i < len(nodes) {
+			if i+1 < len(nodes) {
+				left, right := nodes[i], nodes[i+1]
+				level = append(level, &MerkleNode{
+					Left:  left,
+					Right: right,
+					Hash:  t.nodeHash(left.Hash, right.Hash),
+				})
+				i += 2
+				continue
 			}
-			level = append(level, parent)
+
+			// Odd node left over at this level: promote it unchanged.
+			level = append(level, nodes[i])
+			i++
 		}
 
 		nodes = level
@@ -82,60 +231,171 @@ func (t *DefaultMerkleTree) buildTree() {
 	t.root = nodes[0]
 }
 
-// GenerateProof generates a Merkle proof for the leaf at the given index
-// The proof consists of sibling hashes needed to compute the root.
-func (t *DefaultMerkleTree) GenerateProof(index int) ([][]byte, error) {
+// largestPowerOfTwoBelow returns the largest power of two strictly smaller
+// than n, for n > 1.
+func largestPowerOfTwoBelow(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// buildMinimalHeight builds a minimal-height, left-leaning subtree over
+// leaves, per ModeMinimalHeight.
+func (t *DefaultMerkleTree) buildMinimalHeight(leaves [][]byte) *MerkleNode {
+	if len(leaves) == 1 {
+		return &MerkleNode{Hash: t.leafHash(leaves[0])}
+	}
+
+	k := largestPowerOfTwoBelow(len(leaves))
+	left := t.buildMinimalHeight(leaves[:k])
+	right := t.buildMinimalHeight(leaves[k:])
+	return &MerkleNode{
+		Left:  left,
+		Right: right,
+		Hash:  t.nodeHash(left.Hash, right.Hash),
+	}
+}
+
+// generateMinimalHeightProof walks the same recursive split as
+// buildMinimalHeight, collecting the sibling subtree's root at each level in
+// leaf-to-root order.
+func (t *DefaultMerkleTree) generateMinimalHeightProof(leaves [][]byte, index int) []ProofStep {
+	if len(leaves) == 1 {
+		return nil
+	}
+
+	k := largestPowerOfTwoBelow(len(leaves))
+	if index < k {
+		sibling := t.buildMinimalHeight(leaves[k:])
+		return append(t.generateMinimalHeightProof(leaves[:k], index), ProofStep{Hash: sibling.Hash, Right: true})
+	}
+
+	sibling := t.buildMinimalHeight(leaves[:k])
+	return append(t.generateMinimalHeightProof(leaves[k:], index-k), ProofStep{Hash: sibling.Hash, Right: false})
+}
+
+// proofWithinPeak walks down a peak's subtree of the given height to the
+// leaf at index, collecting sibling hashes in leaf-to-root order.
+func proofWithinPeak(node *MerkleNode, height, index int) []ProofStep {
+	if height == 0 {
+		return nil
+	}
+
+	half := 1 << (height - 1)
+	if index < half {
+		return append(proofWithinPeak(node.Left, height-1, index), ProofStep{Hash: node.Right.Hash, Right: true})
+	}
+	return append(proofWithinPeak(node.Right, height-1, index-half), ProofStep{Hash: node.Left.Hash, Right: false})
+}
+
+// generatePeakProof builds a proof from the ModeDuplicate forest: the path
+// within the peak containing index, followed by the bagging steps that fold
+// that peak's hash up into the root (see bagPeaks).
+func (t *DefaultMerkleTree) generatePeakProof(index int) []ProofStep {
+	offset := 0
+	for pi, p := range t.peaks {
+		size := 1 << p.height
+		if index >= offset+size {
+			offset += size
+			continue
+		}
+
+		proof := proofWithinPeak(p.node, p.height, index-offset)
+
+		if pi < len(t.peaks)-1 {
+			rightBag := t.peaks[len(t.peaks)-1].node.Hash
+			for j := len(t.peaks) - 2; j > pi; j-- {
+				rightBag = t.nodeHash(t.peaks[j].node.Hash, rightBag)
+			}
+			proof = append(proof, ProofStep{Hash: rightBag, Right: true})
+		}
+
+		for j := pi - 1; j >= 0; j-- {
+			proof = append(proof, ProofStep{Hash: t.peaks[j].node.Hash, Right: false})
+		}
+
+		return proof
+	}
+
+	return nil
+}
+
+// GenerateProof generates a Merkle proof for the leaf at the given index.
+// The proof consists of the sibling hashes (with their combining side)
+// needed to recompute the root.
+func (t *DefaultMerkleTree) GenerateProof(index int) ([]ProofStep, error) {
 	if index < 0 || index >= len(t.leaves) {
 		return nil, errors.New("index out of bounds")
 	}
 
-	var proof [][]byte
-	numLeaves := len(t.leaves)
+	if t.mode == ModeMinimalHeight {
+		return t.generateMinimalHeightProof(t.leaves, index), nil
+	}
+
+	if t.mode == ModeDuplicate {
+		return t.generatePeakProof(index), nil
+	}
 
 	var level []*MerkleNode
 	for _, data := range t.leaves {
-		level = append(level, &MerkleNode{Hash: t.hashFn(data)})
+		level = append(level, &MerkleNode{Hash: t.leafHash(data)})
 	}
 
-	for numLeaves > 1 {
-		if len(level)%2 != 0 {
-			level = append(level, level[len(level)-1])
-		}
+	var proof []ProofStep
+	for len(level) > 1 {
+		var next []*MerkleNode
+		nextIndex := index
 
-		siblingIndex := index ^ 1
-		proof = append(proof, level[siblingIndex].Hash)
+		i := 0
+		for i < len(level) {
+			if i+1 < len(level) {
+				left, right := level[i], level[i+1]
+				if index == i {
+					proof = append(proof, ProofStep{Hash: right.Hash, Right: true})
+					nextIndex = len(next)
+				} else if index == i+1 {
+					proof = append(proof, ProofStep{Hash: left.Hash, Right: false})
+					nextIndex = len(next)
+				}
+				next = append(next, &MerkleNode{
+					Left:  left,
+					Right: right,
+					Hash:  t.nodeHash(left.Hash, right.Hash),
+				})
+				i += 2
+				continue
+			}
 
-		var nextLevel []*MerkleNode
-		for i := 0; i < len(level); i += 2 {
-			combined := append(level[i].Hash, level[i+1].Hash...)
-			parent := &MerkleNode{
-				Hash: t.hashFn(combined),
+			// Odd node left over at this level: promote it unchanged.
+			last := level[i]
+			if index == i {
+				nextIndex = len(next)
 			}
-			nextLevel = append(nextLevel, parent)
+			next = append(next, last)
+			i++
 		}
 
-		level = nextLevel
-		numLeaves = len(level)
-		index = index / 2
+		level = next
+		index = nextIndex
 	}
 
 	return proof, nil
 }
 
-// VerifyProof verifies a Merkle proof for a given leaf and index against the provided root hash
-// Recomputes the root from the leaf and proof, and compares it with the provided root.
-func (t *DefaultMerkleTree) VerifyProof(leaf []byte, index int, proof [][]byte, root []byte) bool {
-	hash := t.hashFn(leaf)
+// VerifyProof verifies a Merkle proof for a given leaf against the provided
+// root hash. It recomputes the root from the leaf and proof, and compares
+// it with the provided root.
+func (t *DefaultMerkleTree) VerifyProof(leaf []byte, proof []ProofStep, root []byte) bool {
+	hash := t.leafHash(leaf)
 
-	for _, sibling := range proof {
-		var combined []byte
-		if index%2 == 0 {
-			combined = append(hash, sibling...)
+	for _, step := range proof {
+		if step.Right {
+			hash = t.nodeHash(hash, step.Hash)
 		} else {
-			combined = append(sibling, hash...)
+			hash = t.nodeHash(step.Hash, hash)
 		}
-		hash = t.hashFn(combined)
-		index = index / 2
 	}
 
 	return string(hash) == string(root)
@@ -0,0 +1,198 @@
+package merkle
+
+import "errors"
+
+// multiProofSplit returns how many leaves of a size-leaf subtree go to the
+// left child, and whether the right child continues peeling peaks off a
+// ModeDuplicate forest ("spine") rather than being an ordinary half. It
+// depends only on size/spine and t.mode, never on leaf content, so the
+// prover and verifier can agree on tree shape from the leaf count alone.
+//
+// ModeRFC6962 and ModeMinimalHeight both resolve to the same minimal-height
+// split (see buildMinimalHeight): this is the well known equivalence between
+// promoting an unpaired node level by level and recursively splitting at the
+// largest power of two below n. ModeDuplicate instead peels off its largest
+// peak (see addPeak/bagPeaks) and recurses into the remaining, smaller
+// forest.
+func (t *DefaultMerkleTree) multiProofSplit(size int, spine bool) (leftSize int, rightSpine bool) {
+	if t.mode != ModeDuplicate || !spine {
+		return largestPowerOfTwoBelow(size), false
+	}
+
+	k := 1
+	for k*2 <= size {
+		k *= 2
+	}
+	if k == size {
+		return largestPowerOfTwoBelow(size), false
+	}
+	return k, true
+}
+
+// subtreeHash recomputes, from scratch, the hash of the subtree covering
+// leaves[offset:offset+size] under t's current mode.
+func (t *DefaultMerkleTree) subtreeHash(offset, size int, spine bool) []byte {
+	if size == 1 {
+		return t.leafHash(t.leaves[offset])
+	}
+
+	leftSize, rightSpine := t.multiProofSplit(size, spine)
+	left := t.subtreeHash(offset, leftSize, false)
+	right := t.subtreeHash(offset+leftSize, size-leftSize, rightSpine)
+	return t.nodeHash(left, right)
+}
+
+func rangeHasRequested(requested map[int]bool, offset, size int) bool {
+	for idx := range requested {
+		if idx >= offset && idx < offset+size {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeFlag(leftKnown, rightKnown bool) byte {
+	var flag byte
+	if leftKnown {
+		flag |= 1
+	}
+	if rightKnown {
+		flag |= 2
+	}
+	return flag
+}
+
+func decodeFlag(flag byte) (leftKnown, rightKnown bool) {
+	return flag&1 != 0, flag&2 != 0
+}
+
+// multiProofBuild walks the subtree covering leaves[offset:offset+size],
+// returning nil when that subtree's hash is reconstructible by the verifier
+// from the requested leaves alone, or the subtree's hash when it has to be
+// supplied as proof material. Whenever it combines two children, it records
+// a flag byte (see encodeFlag) plus whichever child hashes weren't already
+// known, so VerifyMultiProof can replay the same combine without ambiguity.
+//
+// An unknown child's hash is pushed onto *hashes the moment that child is
+// resolved - left before recursing into right - rather than deferred until
+// this call returns. VerifyMultiProof consumes *hashes the moment it
+// descends into an unrequested child, which is that same moment; pushing
+// both children's hashes only after both had fully recursed (post-order at
+// the parent) put deeper nested pushes ahead of a shallower sibling's own
+// hash, desyncing the two sides' read/write order.
+func (t *DefaultMerkleTree) multiProofBuild(offset, size int, spine bool, requested map[int]bool, hashes *[][]byte, flags *[]byte) []byte {
+	if !rangeHasRequested(requested, offset, size) {
+		return t.subtreeHash(offset, size, spine)
+	}
+	if size == 1 {
+		return nil
+	}
+
+	leftSize, rightSpine := t.multiProofSplit(size, spine)
+	left := t.multiProofBuild(offset, leftSize, false, requested, hashes, flags)
+	if left != nil {
+		*hashes = append(*hashes, left)
+	}
+	right := t.multiProofBuild(offset+leftSize, size-leftSize, rightSpine, requested, hashes, flags)
+	if right != nil {
+		*hashes = append(*hashes, right)
+	}
+
+	*flags = append(*flags, encodeFlag(left == nil, right == nil))
+	return nil
+}
+
+// GenerateMultiProof produces a compact proof that the leaves at indices are
+// part of the tree, sharing any internal hash needed by more than one of
+// them instead of emitting it once per leaf the way calling GenerateProof
+// for each index would.
+func (t *DefaultMerkleTree) GenerateMultiProof(indices []int) (hashes [][]byte, flags []byte, err error) {
+	if len(t.leaves) == 0 {
+		return nil, nil, errors.New("tree is empty")
+	}
+
+	requested := make(map[int]bool, len(indices))
+	for _, idx := range indices {
+		if idx < 0 || idx >= len(t.leaves) {
+			return nil, nil, errors.New("index out of bounds")
+		}
+		requested[idx] = true
+	}
+
+	hashes = [][]byte{}
+	flags = []byte{}
+	t.multiProofBuild(0, len(t.leaves), true, requested, &hashes, &flags)
+	return hashes, flags, nil
+}
+
+// multiProofVerify mirrors multiProofBuild: it either consumes the next
+// proof hash for a subtree with no requested leaves, returns a requested
+// leaf's hash directly, or recombines two already-resolved children,
+// cross-checking the flag against what the requested set implies.
+func (t *DefaultMerkleTree) multiProofVerify(offset, size int, spine bool, requested map[int]bool, leaves map[int][]byte, hashes [][]byte, flags []byte, hi, fi *int) ([]byte, bool) {
+	if !rangeHasRequested(requested, offset, size) {
+		if *hi >= len(hashes) {
+			return nil, false
+		}
+		h := hashes[*hi]
+		*hi++
+		return h, true
+	}
+	if size == 1 {
+		leaf, ok := leaves[offset]
+		if !ok {
+			return nil, false
+		}
+		return t.leafHash(leaf), true
+	}
+
+	leftSize, rightSpine := t.multiProofSplit(size, spine)
+	left, ok := t.multiProofVerify(offset, leftSize, false, requested, leaves, hashes, flags, hi, fi)
+	if !ok {
+		return nil, false
+	}
+	right, ok := t.multiProofVerify(offset+leftSize, size-leftSize, rightSpine, requested, leaves, hashes, flags, hi, fi)
+	if !ok {
+		return nil, false
+	}
+
+	if *fi >= len(flags) {
+		return nil, false
+	}
+	wantLeftKnown := rangeHasRequested(requested, offset, leftSize)
+	wantRightKnown := rangeHasRequested(requested, offset+leftSize, size-leftSize)
+	gotLeftKnown, gotRightKnown := decodeFlag(flags[*fi])
+	*fi++
+	if gotLeftKnown != wantLeftKnown || gotRightKnown != wantRightKnown {
+		return nil, false
+	}
+
+	return t.nodeHash(left, right), true
+}
+
+// VerifyMultiProof verifies a proof produced by GenerateMultiProof against
+// root, for the leaves given by index, out of numLeaves total leaves. t only
+// needs to share its hashFn and mode with the tree the proof was generated
+// from (e.g. a freshly constructed, empty tree) - verifying doesn't require
+// holding every leaf the proof was built over, just numLeaves (compare
+// VerifyReaderProof).
+func (t *DefaultMerkleTree) VerifyMultiProof(numLeaves int, leaves map[int][]byte, hashes [][]byte, flags []byte, root []byte) bool {
+	if numLeaves == 0 || len(leaves) == 0 {
+		return false
+	}
+
+	requested := make(map[int]bool, len(leaves))
+	for idx := range leaves {
+		if idx < 0 || idx >= numLeaves {
+			return false
+		}
+		requested[idx] = true
+	}
+
+	hi, fi := 0, 0
+	hash, ok := t.multiProofVerify(0, numLeaves, true, requested, leaves, hashes, flags, &hi, &fi)
+	if !ok || hi != len(hashes) || fi != len(flags) {
+		return false
+	}
+	return string(hash) == string(root)
+}
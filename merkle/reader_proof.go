@@ -0,0 +1,180 @@
+package merkle
+
+import (
+	"errors"
+	"io"
+)
+
+// streamPeak is a peak in the online forest built by BuildReaderProof: a
+// perfect subtree, height levels tall, covering leaves [start, start+2^height).
+type streamPeak struct {
+	height int
+	hash   []byte
+	start  uint64
+}
+
+// BuildReaderProof reads r in segmentSize-byte chunks, treating each chunk
+// as a leaf, and computes both the Merkle root and a proof for the leaf at
+// proofIndex in a single pass. It merges leaves into a forest of perfect
+// subtrees the same way DefaultMerkleTree's ModeDuplicate AddLeaf does, so
+// only the O(log n) peak hashes and the proof path collected so far need to
+// be kept in memory - the input never has to be buffered or hashed twice.
+func BuildReaderProof(r io.Reader, hashFn HashFn, segmentSize int, proofIndex uint64) (root []byte, proof [][]byte, numLeaves uint64, err error) {
+	if segmentSize <= 0 {
+		return nil, nil, 0, errors.New("segmentSize must be positive")
+	}
+
+	var peaks []streamPeak
+	buf := make([]byte, segmentSize)
+
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			leaf := append([]byte{}, buf[:n]...)
+			peaks, proof = pushStreamLeaf(peaks, hashFn, leaf, numLeaves, proofIndex, proof)
+			numLeaves++
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, nil, 0, readErr
+		}
+	}
+
+	if numLeaves == 0 {
+		return nil, nil, 0, nil
+	}
+	if proofIndex >= numLeaves {
+		return nil, nil, 0, errors.New("index out of bounds")
+	}
+
+	root, proof = bagStreamPeaks(peaks, hashFn, proofIndex, proof)
+	return root, proof, numLeaves, nil
+}
+
+// pushStreamLeaf merges a new leaf into the forest, the same way
+// DefaultMerkleTree.addPeak does, additionally recording a proof hash
+// whenever a merge combines the peak containing proofIndex with its
+// sibling.
+func pushStreamLeaf(peaks []streamPeak, hashFn HashFn, leaf []byte, index, proofIndex uint64, proof [][]byte) ([]streamPeak, [][]byte) {
+	node := streamPeak{height: 0, hash: hashFn(leaf), start: index}
+
+	for len(peaks) > 0 && peaks[len(peaks)-1].height == node.height {
+		top := peaks[len(peaks)-1]
+		peaks = peaks[:len(peaks)-1]
+
+		size := uint64(1) << uint(top.height)
+		if proofIndex >= top.start && proofIndex < top.start+size {
+			proof = append(proof, node.hash)
+		} else if proofIndex >= node.start && proofIndex < node.start+size {
+			proof = append(proof, top.hash)
+		}
+
+		node = streamPeak{
+			height: top.height + 1,
+			hash:   hashFn(append(append([]byte{}, top.hash...), node.hash...)),
+			start:  top.start,
+		}
+	}
+
+	return append(peaks, node), proof
+}
+
+// bagStreamPeaks combines the forest's peaks into a single root, right to
+// left, the same way DefaultMerkleTree.bagPeaks does, appending along the
+// way the bagging hashes needed to verify the peak containing proofIndex.
+func bagStreamPeaks(peaks []streamPeak, hashFn HashFn, proofIndex uint64, proof [][]byte) ([]byte, [][]byte) {
+	pi := 0
+	for peaks[pi].start+(1<<uint(peaks[pi].height)) <= proofIndex {
+		pi++
+	}
+
+	if pi < len(peaks)-1 {
+		rightBag := peaks[len(peaks)-1].hash
+		for j := len(peaks) - 2; j > pi; j-- {
+			rightBag = hashFn(append(append([]byte{}, peaks[j].hash...), rightBag...))
+		}
+		proof = append(proof, rightBag)
+	}
+	for j := pi - 1; j >= 0; j-- {
+		proof = append(proof, peaks[j].hash)
+	}
+
+	hash := peaks[len(peaks)-1].hash
+	for i := len(peaks) - 2; i >= 0; i-- {
+		hash = hashFn(append(append([]byte{}, peaks[i].hash...), hash...))
+	}
+	return hash, proof
+}
+
+// peakHeights returns the heights of the peaks of a forest holding numLeaves
+// leaves, ordered left to right (tallest to shortest) - one per set bit of
+// numLeaves, from its most to least significant bit. This mirrors the shape
+// pushStreamLeaf builds regardless of the order leaves arrived in, so
+// VerifyReaderProof can replay it from numLeaves alone.
+func peakHeights(numLeaves uint64) []int {
+	var heights []int
+	for h := 63; h >= 0; h-- {
+		if numLeaves&(1<<uint(h)) != 0 {
+			heights = append(heights, h)
+		}
+	}
+	return heights
+}
+
+// VerifyReaderProof verifies a proof produced by BuildReaderProof for the
+// leaf at index out of numLeaves total leaves, without needing access to
+// the original stream.
+func VerifyReaderProof(proof [][]byte, index, numLeaves uint64, leaf []byte, hashFn HashFn, root []byte) bool {
+	if numLeaves == 0 || index >= numLeaves {
+		return false
+	}
+
+	heights := peakHeights(numLeaves)
+	offset := uint64(0)
+	pi := 0
+	for ; pi < len(heights); pi++ {
+		size := uint64(1) << uint(heights[pi])
+		if index < offset+size {
+			break
+		}
+		offset += size
+	}
+	if pi == len(heights) {
+		return false
+	}
+
+	local := index - offset
+	hash := hashFn(leaf)
+	step := 0
+
+	for level := 0; level < heights[pi]; level++ {
+		if step >= len(proof) {
+			return false
+		}
+		if (local>>uint(level))&1 == 0 {
+			hash = hashFn(append(append([]byte{}, hash...), proof[step]...))
+		} else {
+			hash = hashFn(append(append([]byte{}, proof[step]...), hash...))
+		}
+		step++
+	}
+
+	if pi < len(heights)-1 {
+		if step >= len(proof) {
+			return false
+		}
+		hash = hashFn(append(append([]byte{}, hash...), proof[step]...))
+		step++
+	}
+	for j := pi - 1; j >= 0; j-- {
+		if step >= len(proof) {
+			return false
+		}
+		hash = hashFn(append(append([]byte{}, proof[step]...), hash...))
+		step++
+	}
+
+	return step == len(proof) && string(hash) == string(root)
+}
@@ -0,0 +1,397 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Storage is a pluggable key-value backend for SparseMerkleTree nodes, keyed
+// by content hash, so callers can back it with an in-memory map, BoltDB,
+// LevelDB, or anything else that satisfies this interface.
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// ErrNodeNotFound is returned by a Storage implementation's Get when key
+// isn't present.
+var ErrNodeNotFound = errors.New("merkle: node not found")
+
+const (
+	smtLeafTag     = 0x00
+	smtInternalTag = 0x01
+
+	// DefaultSparseMerkleTreeDepth is the usual depth for a sparse tree
+	// keyed by a 256-bit hash (e.g. sha256), one level per bit of the key's
+	// hash.
+	DefaultSparseMerkleTreeDepth = 256
+)
+
+// SparseMerkleTree is a key -> value commitment over a fixed-depth binary
+// tree indexed by hash(key). Unlike DefaultMerkleTree it supports random
+// updates: nodes are content-addressed in Storage, and any subtree
+// containing exactly one leaf is collapsed and stored as that single leaf,
+// so Update/Get/Prove touch only O(log N) stored nodes regardless of depth.
+type SparseMerkleTree struct {
+	hashFn  HashFn
+	storage Storage
+	depth   int
+	empty   [][]byte // empty[d] is the well-known hash of an empty subtree rooted at depth d (depth-d levels above a leaf)
+	root    []byte
+}
+
+// NewSparseMerkleTree returns an empty tree with depth levels (in bits of
+// hashFn's output used as the key path, see DefaultSparseMerkleTreeDepth),
+// backed by storage.
+func NewSparseMerkleTree(hashFn HashFn, storage Storage, depth int) *SparseMerkleTree {
+	t := &SparseMerkleTree{hashFn: hashFn, storage: storage, depth: depth}
+
+	t.empty = make([][]byte, depth+1)
+	t.empty[depth] = make([]byte, len(hashFn(nil)))
+	for d := depth - 1; d >= 0; d-- {
+		t.empty[d] = t.internalHash(t.empty[d+1], t.empty[d+1])
+	}
+	t.root = t.empty[0]
+
+	return t
+}
+
+// Root returns the current root hash.
+func (t *SparseMerkleTree) Root() []byte {
+	return t.root
+}
+
+func (t *SparseMerkleTree) leafHash(key, value []byte) []byte {
+	return t.hashFn(append(append([]byte{smtLeafTag}, key...), value...))
+}
+
+func (t *SparseMerkleTree) internalHash(left, right []byte) []byte {
+	return t.hashFn(append(append([]byte{smtInternalTag}, left...), right...))
+}
+
+// path hashes key into the bit sequence used to walk the tree.
+func (t *SparseMerkleTree) path(key []byte) []byte {
+	return t.hashFn(key)
+}
+
+func bitAt(path []byte, i int) bool {
+	return path[i/8]&(1<<uint(7-i%8)) != 0
+}
+
+func encodeLeaf(key, value []byte) []byte {
+	buf := make([]byte, 0, 5+len(key)+len(value))
+	buf = append(buf, smtLeafTag)
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(key)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	return buf
+}
+
+func decodeLeaf(raw []byte) (key, value []byte, ok bool) {
+	if len(raw) < 5 || raw[0] != smtLeafTag {
+		return nil, nil, false
+	}
+	keyLen := binary.BigEndian.Uint32(raw[1:5])
+	if uint32(len(raw)-5) < keyLen {
+		return nil, nil, false
+	}
+	return raw[5 : 5+keyLen], raw[5+keyLen:], true
+}
+
+func encodeInternal(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, smtInternalTag)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	return buf
+}
+
+func decodeInternal(raw []byte, hashLen int) (left, right []byte, ok bool) {
+	if len(raw) != 1+2*hashLen || raw[0] != smtInternalTag {
+		return nil, nil, false
+	}
+	return raw[1 : 1+hashLen], raw[1+hashLen:], true
+}
+
+// Get returns the value stored for key, or (nil, nil) if key isn't present.
+func (t *SparseMerkleTree) Get(key []byte) ([]byte, error) {
+	path := t.path(key)
+	hashLen := len(t.empty[t.depth])
+	hash := t.root
+
+	for d := 0; d <= t.depth; d++ {
+		if bytes.Equal(hash, t.empty[d]) {
+			return nil, nil
+		}
+
+		raw, err := t.storage.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if leafKey, value, ok := decodeLeaf(raw); ok {
+			if bytes.Equal(t.path(leafKey), path) {
+				return value, nil
+			}
+			return nil, nil
+		}
+
+		if d == t.depth {
+			return nil, errors.New("merkle: corrupt node")
+		}
+
+		left, right, ok := decodeInternal(raw, hashLen)
+		if !ok {
+			return nil, errors.New("merkle: corrupt node")
+		}
+		if bitAt(path, d) {
+			hash = right
+		} else {
+			hash = left
+		}
+	}
+
+	return nil, errors.New("merkle: corrupt node")
+}
+
+// Update sets the value associated with key, creating it if it doesn't
+// already exist, and returns the new root hash.
+func (t *SparseMerkleTree) Update(key, value []byte) ([]byte, error) {
+	path := t.path(key)
+	hashLen := len(t.empty[t.depth])
+
+	var siblings [][]byte // siblings[d] is the hash off-path at depth d
+	hash := t.root
+	depth := 0
+
+	for ; depth <= t.depth; depth++ {
+		if bytes.Equal(hash, t.empty[depth]) {
+			break
+		}
+
+		raw, err := t.storage.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if leafKey, leafValue, ok := decodeLeaf(raw); ok {
+			leafPath := t.path(leafKey)
+			if bytes.Equal(leafPath, path) {
+				if err := t.storage.Delete(hash); err != nil {
+					return nil, err
+				}
+				break
+			}
+
+			// Two distinct keys collide down to depth: the existing leaf
+			// keeps its own content-addressed entry, but our new leaf needs
+			// internal nodes pushed down through the shared prefix until
+			// the two paths diverge.
+			divergeDepth := depth
+			for divergeDepth < t.depth && bitAt(path, divergeDepth) == bitAt(leafPath, divergeDepth) {
+				divergeDepth++
+			}
+			if divergeDepth == t.depth {
+				return nil, errors.New("merkle: key path collision")
+			}
+
+			for d := depth; d < divergeDepth; d++ {
+				siblings = append(siblings, t.empty[d+1])
+			}
+			siblings = append(siblings, t.leafHash(leafKey, leafValue))
+			depth = divergeDepth + 1
+			break
+		}
+
+		left, right, ok := decodeInternal(raw, hashLen)
+		if !ok {
+			return nil, errors.New("merkle: corrupt node")
+		}
+		if err := t.storage.Delete(hash); err != nil {
+			return nil, err
+		}
+		if bitAt(path, depth) {
+			siblings = append(siblings, left)
+			hash = right
+		} else {
+			siblings = append(siblings, right)
+			hash = left
+		}
+	}
+
+	newHash := t.leafHash(key, value)
+	if err := t.storage.Put(newHash, encodeLeaf(key, value)); err != nil {
+		return nil, err
+	}
+
+	for d := depth - 1; d >= 0; d-- {
+		sibling := siblings[d]
+		var left, right []byte
+		if bitAt(path, d) {
+			left, right = sibling, newHash
+		} else {
+			left, right = newHash, sibling
+		}
+		newHash = t.internalHash(left, right)
+		if !bytes.Equal(newHash, t.empty[d]) {
+			if err := t.storage.Put(newHash, encodeInternal(left, right)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.root = newHash
+	return t.root, nil
+}
+
+// SparseMerkleProof is a compressed inclusion/exclusion proof for a single
+// key: Bitmap marks which siblings along the path are non-empty, and only
+// those siblings' hashes are carried in Siblings, so empty siblings never
+// need to be transmitted. Depth is how many levels the walk that produced
+// this proof actually descended before it hit a collapsed leaf or an empty
+// subtree - see Update's collapsing of any single-leaf subtree down to just
+// that leaf, with no stored nodes above it. VerifyProof replays exactly
+// those Depth levels instead of assuming a full t.depth-level path.
+//
+// OtherLeafHash is set only for a non-membership proof whose path bottoms
+// out at depth Depth on a different key's collapsed leaf rather than a
+// genuinely empty subtree: that leaf's hash sits directly at Depth, with no
+// further internal nodes above it to reconstruct, so it has to be carried
+// verbatim instead of derived from t.empty.
+type SparseMerkleProof struct {
+	Depth         int
+	OtherLeafHash []byte
+	Bitmap        []byte
+	Siblings      [][]byte
+}
+
+// Prove returns a compressed proof for key, usable to verify either that
+// key maps to some value (membership) or that key is absent (non-membership)
+// via VerifyProof.
+func (t *SparseMerkleTree) Prove(key []byte) (*SparseMerkleProof, error) {
+	path := t.path(key)
+	hashLen := len(t.empty[t.depth])
+
+	proof := &SparseMerkleProof{Bitmap: make([]byte, (t.depth+7)/8)}
+	hash := t.root
+
+	for d := 0; d <= t.depth; d++ {
+		if bytes.Equal(hash, t.empty[d]) {
+			proof.Depth = d
+			return proof, nil
+		}
+
+		raw, err := t.storage.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if leafKey, _, ok := decodeLeaf(raw); ok {
+			proof.Depth = d
+			if leafPath := t.path(leafKey); !bytes.Equal(leafPath, path) {
+				// This collapsed leaf belongs to a different key: its hash
+				// sits directly at Depth (the subtree is collapsed, so there
+				// are no intermediate levels to walk down to where the two
+				// paths would diverge), same as Get treats it.
+				proof.OtherLeafHash = hash
+			}
+			return proof, nil
+		}
+
+		if d == t.depth {
+			return nil, errors.New("merkle: corrupt node")
+		}
+
+		left, right, ok := decodeInternal(raw, hashLen)
+		if !ok {
+			return nil, errors.New("merkle: corrupt node")
+		}
+
+		var sibling []byte
+		if bitAt(path, d) {
+			sibling, hash = left, right
+		} else {
+			sibling, hash = right, left
+		}
+
+		if !bytes.Equal(sibling, t.empty[d+1]) {
+			proof.Bitmap[d/8] |= 1 << uint(7-d%8)
+			proof.Siblings = append(proof.Siblings, sibling)
+		}
+	}
+
+	return nil, errors.New("merkle: corrupt node")
+}
+
+// VerifyProof checks a proof produced by Prove against root. A nil value
+// verifies that key is absent from the tree; a non-nil value verifies that
+// key maps to it.
+func (t *SparseMerkleTree) VerifyProof(key, value []byte, proof *SparseMerkleProof, root []byte) bool {
+	path := t.path(key)
+
+	var hash []byte
+	switch {
+	case value != nil:
+		hash = t.leafHash(key, value)
+	case proof.OtherLeafHash != nil:
+		hash = proof.OtherLeafHash
+	default:
+		hash = t.empty[proof.Depth]
+	}
+
+	si := len(proof.Siblings) - 1
+	for d := proof.Depth - 1; d >= 0; d-- {
+		var sibling []byte
+		if proof.Bitmap[d/8]&(1<<uint(7-d%8)) != 0 {
+			if si < 0 {
+				return false
+			}
+			sibling = proof.Siblings[si]
+			si--
+		} else {
+			sibling = t.empty[d+1]
+		}
+
+		if bitAt(path, d) {
+			hash = t.internalHash(sibling, hash)
+		} else {
+			hash = t.internalHash(hash, sibling)
+		}
+	}
+
+	return si == -1 && bytes.Equal(hash, root)
+}
+
+// MapStorage is an in-memory Storage backed by a map, handy for tests and
+// small trees; back SparseMerkleTree with BoltDB, LevelDB, etc. instead for
+// anything that needs to persist.
+type MapStorage struct {
+	data map[string][]byte
+}
+
+// NewMapStorage returns an empty in-memory Storage.
+func NewMapStorage() *MapStorage {
+	return &MapStorage{data: make(map[string][]byte)}
+}
+
+func (m *MapStorage) Get(key []byte) ([]byte, error) {
+	v, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return v, nil
+}
+
+func (m *MapStorage) Put(key, value []byte) error {
+	m.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *MapStorage) Delete(key []byte) error {
+	delete(m.data, string(key))
+	return nil
+}